@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	copyDir "github.com/otiai10/copy"
 	"github.com/pterm/pterm"
@@ -16,20 +28,79 @@ import (
 
 // constants
 const CONFIG_FILE_NAME string = "l1onResources.json"
+const LOCK_FILE_NAME string = "l1onResources.lock.json"
 const VERSION string = "4.0.0"
 
 // types
 
 type Projects struct {
-	Projects []Project `json:"projects"`
+	Projects    []Project `json:"projects"`
+	Concurrency int       `json:"concurrency"`
+	FailFast    bool      `json:"fail_fast"`
+	Defaults    Defaults  `json:"defaults"`
 }
+
+// Defaults holds values applied to every Project that doesn't set its own.
+type Defaults struct {
+	TempDirectory string `json:"temp_directory"`
+	Remote        string `json:"remote"`
+	Ref           string `json:"ref"`
+}
+
 type Project struct {
-	RepoURL             string `json:"repo_url"`
-	DestinationPath     string `json:"destination_path"`
-	TempDirectory       string `json:"temp_directory"`
-	DeleteTempDirectory bool   `json:"delete_temp_dir_after_done"`
-	ProjectName         string `json:"project_name"`
-	PurgeDestination    bool   `json:"purge_destination_before_copy"`
+	RepoURL             string    `json:"repo_url"`
+	DestinationPath     string    `json:"destination_path"`
+	TempDirectory       string    `json:"temp_directory"`
+	DeleteTempDirectory bool      `json:"delete_temp_dir_after_done"`
+	ProjectName         string    `json:"project_name"`
+	PurgeDestination    bool      `json:"purge_destination_before_copy"`
+	SparsePaths         []string  `json:"sparse_paths"`
+	Depth               int       `json:"depth"`
+	Ref                 string    `json:"ref"`
+	AtomicSwap          bool      `json:"atomic_swap"`
+	Remote              string    `json:"remote"`
+	Overlays            []Overlay `json:"overlays"`
+}
+
+// Overlay is additional content merged into a Project's DestinationPath
+// after the base project has been cloned and copied. Later overlays win.
+type Overlay struct {
+	RepoURL     string   `json:"repo_url"`
+	Ref         string   `json:"ref"`
+	SparsePaths []string `json:"sparse_paths"`
+	Subpath     string   `json:"subpath"`
+}
+
+// LockEntry pins a single repo (a Project or one of its Overlays) to the
+// commit SHA that was actually checked out on the last successful run.
+type LockEntry struct {
+	ProjectName string `json:"project_name"`
+	RepoURL     string `json:"repo_url"`
+	CommitSHA   string `json:"commit_sha"`
+}
+
+// Lockfile is the contents of l1onResources.lock.json.
+type Lockfile struct {
+	Repos []LockEntry `json:"repos"`
+}
+
+// CLIFlags holds the parsed command-line flags for a run.
+type CLIFlags struct {
+	DryRun bool
+	Plan   bool
+	Update bool
+}
+
+// cli is populated once by parseFlags() at the top of main.
+var cli CLIFlags
+
+// DiffSummary is the result of comparing a project's resolved source tree
+// against what is already on disk at its DestinationPath.
+type DiffSummary struct {
+	FilesAdded    int
+	FilesModified int
+	FilesRemoved  int
+	BytesDelta    int64
 }
 
 // helpers
@@ -76,13 +147,19 @@ func checkIfFileExists(path string) bool {
 Delete a directory and all its contents
 
 Expects
-1. path - Path to the directory
+1. writer - Where this project's progress is printed
+2. path - Path to the directory
+3. dryRun - If true, only log what would happen instead of deleting anything
 
 Returns
 1. boolean - If the directory was successfully deleted or not.
 *
 */
-func deleteDirectory(path string) bool {
+func deleteDirectory(writer io.Writer, path string, dryRun bool) bool {
+	if dryRun {
+		logPlannedAction(writer, "Would delete directory", path)
+		return true
+	}
 	Info("Deleting the directory: " + path)
 	err := os.RemoveAll(path)
 	if err != nil {
@@ -94,34 +171,261 @@ func deleteDirectory(path string) bool {
 
 /*
 *
-Clone the repository in the temp directory
+Run a git command inside an already-cloned directory.
+Workers run concurrently (see runProjects), so this sets cmd.Dir instead
+of os.Chdir-ing the process-wide working directory, which two workers
+would otherwise race on and run git in each other's clone dir. Errors are
+logged to the project's own writer so concurrent output doesn't interleave
+outside its MultiPrinter area.
 
 Expects
-1. repoURL - URL of the repository
-2. directory - Directory where the repository will be cloned
+1. writer - Where this project's progress is printed
+2. directory - Directory to run the git command in
+3. args - The git subcommand and its arguments
+
+Returns
+1. boolean - If the git command completed successfully or not.
+*
+*/
+func runGitCommandInDir(writer io.Writer, directory string, args ...string) bool {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = directory
+	if err := cmd.Run(); err != nil {
+		WarningW(writer, "Error while running 'git "+strings.Join(args, " ")+"' in: "+directory)
+		return false
+	}
+	return true
+}
+
+/*
+*
+Run a git command inside an already-cloned directory and capture its
+stdout, e.g. for "rev-parse HEAD". Uses cmd.Dir rather than os.Chdir for
+the same concurrency-safety reason as runGitCommandInDir.
+
+Expects
+1. writer - Where this project's progress is printed
+2. directory - Directory to run the git command in
+3. args - The git subcommand and its arguments
+
+Returns
+1. string - Trimmed stdout of the command
+2. boolean - If the git command completed successfully or not.
+*
+*/
+func gitOutputInDir(writer io.Writer, directory string, args ...string) (string, bool) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = directory
+	output, err := cmd.Output()
+	if err != nil {
+		WarningW(writer, "Error while running 'git "+strings.Join(args, " ")+"' in: "+directory)
+		return "", false
+	}
+	return strings.TrimSpace(string(output)), true
+}
+
+/*
+*
+Set up sparse-checkout in an already-cloned (--no-checkout) directory so
+that only project.SparsePaths are populated, then check out project.Ref.
+A glob pattern (e.g. "docs/*.md") forces non-cone mode since cone mode
+only understands directory prefixes.
+
+The initial clone was shallow (--depth N), so if Ref is a full commit SHA
+(as pinned by the lock file on a repeat run) it may not have been fetched
+at all: a shallow clone only has the history reachable from the tip, not
+every SHA. Fetch that SHA specifically, falling back to a full unshallow,
+before attempting the checkout. remote must be the name the origin remote
+currently answers to in this clone: cloneRepository may have already
+renamed it via applyRemoteAlias before calling this, and fetching
+"origin" against a clone that no longer has an "origin" remote fails.
+
+Expects
+1. writer - Where this project's progress is printed
+2. project - The project whose SparsePaths/Ref should be applied
+3. directory - Directory where the repository was cloned
+4. remote - The name of the origin remote in this clone right now
+
+Returns
+1. boolean - If the sparse-checkout set up and ref checkout succeeded or not.
+*
+*/
+func applySparseCheckout(writer io.Writer, project Project, directory string, remote string) bool {
+	coneMode := "--cone"
+	for _, sparsePath := range project.SparsePaths {
+		if strings.ContainsAny(sparsePath, "*?[") {
+			coneMode = "--no-cone"
+			break
+		}
+	}
+
+	if !runGitCommandInDir(writer, directory, "sparse-checkout", "init", coneMode) {
+		return false
+	}
+
+	setArgs := append([]string{"sparse-checkout", "set"}, project.SparsePaths...)
+	if !runGitCommandInDir(writer, directory, setArgs...) {
+		return false
+	}
+
+	ref := project.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if isCommitSHA(ref) {
+		if !runGitCommandInDir(writer, directory, "fetch", "--depth", "1", remote, ref) {
+			runGitCommandInDir(writer, directory, "fetch", "--unshallow")
+		}
+	}
+	if !runGitCommandInDir(writer, directory, "checkout", ref) {
+		WarningW(writer, "Error while checking out ref: "+ref)
+		return false
+	}
+	return true
+}
+
+/*
+*
+Check whether ref looks like a full git commit SHA (40 hex characters),
+as opposed to a branch or tag name.
+
+Expects
+1. ref - The ref to check
+
+Returns
+1. boolean - If ref is a 40-character hex string
+*
+*/
+func isCommitSHA(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, r := range ref {
+		isHexDigit := (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+		if !isHexDigit {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+*
+Check out project.Ref (branch/tag/commit) in an already-cloned directory.
+A no-op when Ref is unset, since a plain clone already leaves the
+remote's default branch checked out.
+
+Expects
+1. writer - Where this project's progress is printed
+2. directory - Directory where the repository was cloned
+3. ref - Branch/tag/commit to check out; "" is a no-op
+
+Returns
+1. boolean - If the ref was checked out successfully or not.
+*
+*/
+func checkoutRef(writer io.Writer, directory string, ref string) bool {
+	if ref == "" {
+		return true
+	}
+	if !runGitCommandInDir(writer, directory, "checkout", ref) {
+		WarningW(writer, "Error while checking out ref: "+ref)
+		return false
+	}
+	return true
+}
+
+/*
+*
+Rename the default "origin" remote to project.Remote, so the alias
+configured in the manifest actually shows up in the clone's git config.
+A no-op when Remote is unset or is already "origin".
+
+Expects
+1. writer - Where this project's progress is printed
+2. directory - Directory where the repository was cloned
+3. remote - The desired remote alias; "" or "origin" is a no-op
+
+Returns
+1. boolean - If the remote was renamed successfully or not.
+*
+*/
+func applyRemoteAlias(writer io.Writer, directory string, remote string) bool {
+	if remote == "" || remote == "origin" {
+		return true
+	}
+	if !runGitCommandInDir(writer, directory, "remote", "rename", "origin", remote) {
+		WarningW(writer, "Error while renaming the origin remote to: "+remote)
+		return false
+	}
+	return true
+}
+
+/*
+*
+Clone the repository in the temp directory.
+When project.SparsePaths is non-empty, this does a filtered, no-checkout
+clone and then narrows the checkout to just those paths instead of
+fetching the full history and every blob only to throw most of it away.
+
+Expects
+1. writer - Where this project's progress is printed
+2. project - The project to clone
+3. directory - Directory where the repository will be cloned
+4. dryRun - If true, only log what would happen instead of cloning anything
 
 Returns
 1. boolean - If the repository was successfully cloned or not.
 *
 */
-func cloneRepository(repoName string, directory string) bool {
-	Info("Cloning the repository: " + repoName)
-	currDirectory, _ := os.Getwd()
+func cloneRepository(writer io.Writer, project Project, directory string, dryRun bool) bool {
+	repoName := project.RepoURL
+	if dryRun {
+		logPlannedAction(writer, "Would clone repository", repoName+" -> "+directory)
+		return true
+	}
+	InfoW(writer, "Cloning the repository: "+repoName)
+
+	remote := project.Remote
+	if remote == "" {
+		remote = "origin"
+	}
+
+	if len(project.SparsePaths) > 0 {
+		depth := project.Depth
+		if depth <= 0 {
+			depth = 1
+		}
+		cmd := exec.Command("git", "clone", "--filter=blob:none", "--no-checkout", "--depth", fmt.Sprint(depth), repoName, directory)
+		err := cmd.Run()
+		if err != nil {
+			InfoW(writer, "Will try doing a git pull instead of git clone")
+			if !applySparseCheckout(writer, project, directory, "origin") {
+				return false
+			}
+			if !runGitCommandInDir(writer, directory, "pull") {
+				WarningW(writer, "Error while cloning the repository: "+repoName)
+				return false
+			}
+			return true
+		}
+		applyRemoteAlias(writer, directory, project.Remote)
+		return applySparseCheckout(writer, project, directory, remote)
+	}
+
 	cmd := exec.Command("git", "clone", repoName, directory)
 	err := cmd.Run()
 
 	if err != nil {
-		Info("Will try doing a git pull instead of git clone")
-		os.Chdir(directory)
-		cmd := exec.Command("git", "pull")
-		err := cmd.Run()
-		os.Chdir(currDirectory)
-		if err != nil {
-			Warning("Error while cloning the repository: " + repoName)
+		InfoW(writer, "Will try doing a git pull instead of git clone")
+		if !runGitCommandInDir(writer, directory, "pull") {
+			WarningW(writer, "Error while cloning the repository: "+repoName)
 			return false
 		}
+	} else {
+		applyRemoteAlias(writer, directory, project.Remote)
 	}
-	return true
+	return checkoutRef(writer, directory, project.Ref)
 }
 
 /*
@@ -147,14 +451,20 @@ func checkIfDirectoryExists(path string) bool {
 Check if the directory exists. If the directory does not exist, we will create the directory. Otherwise we will use the directory
 
 Expects
-1. path - Path to the directory
+1. writer - Where this project's progress is printed
+2. path - Path to the directory
+3. dryRun - If true, only log what would happen instead of creating anything
 
 Returns
 1. boolean - If the directory was successfully created or not.
 
 *
 */
-func createDirectoryIfNotExists(path string) bool {
+func createDirectoryIfNotExists(writer io.Writer, path string, dryRun bool) bool {
+	if dryRun {
+		logPlannedAction(writer, "Would create directory (if missing)", path)
+		return true
+	}
 	Info("Validating if we need to create the new directory : " + path)
 	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
 		err := os.MkdirAll(path, os.ModePerm)
@@ -235,6 +545,535 @@ func Warning(format string, args ...interface{}) {
 	fmt.Printf("\x1b[36;1m%s\x1b[0m\n", fmt.Sprintf(format, args...))
 }
 
+/*
+* Writer-scoped versions of Log/Info/Success/Warning.
+Used when several projects are being processed concurrently so that each
+project's output lands in its own pterm.MultiPrinter area instead of
+interleaving on stdout.
+*/
+func LogW(writer io.Writer, message string, tab bool) {
+	if tab {
+		fmt.Fprintln(writer, "> "+message)
+	} else {
+		fmt.Fprintln(writer, message)
+	}
+}
+
+func InfoW(writer io.Writer, format string, args ...interface{}) {
+	pterm.Info.WithWriter(writer).Println(fmt.Sprintf(format, args...))
+}
+
+func SuccessW(writer io.Writer, format string, args ...interface{}) {
+	pterm.Success.WithWriter(writer).Println(fmt.Sprintf(format, args...))
+}
+
+func WarningW(writer io.Writer, format string, args ...interface{}) {
+	fmt.Fprintf(writer, "\x1b[36;1m%s\x1b[0m\n", fmt.Sprintf(format, args...))
+}
+
+/*
+*
+Append a short, unique suffix to a base temp directory so that two
+projects sharing the same base temp path don't stomp on each other's
+clones when processed concurrently.
+
+Expects
+1. base - The configured temp_directory
+
+Returns
+1. string - base with a "-<pid>-<random>" suffix appended
+*
+*/
+func uniqueTempDir(base string) string {
+	return fmt.Sprintf("%s-%d-%d", base, os.Getpid(), rand.Int63())
+}
+
+/*
+*
+Remove orphaned `.new-*`/`.old-*` siblings left behind by an
+atomicSwapDestination that was interrupted before it could finish. A
+`.old-*` is a stale backup of a destination that was already swapped in
+successfully, so it is safe to delete. A `.new-*` is a staging copy that
+never made it into place, so it is also safe to delete.
+
+Expects
+1. writer - Where progress for this project is printed
+2. destinationPath - The project's DestinationPath
+
+Returns
+1. void
+*
+*/
+func cleanupOrphanSwapSiblings(writer io.Writer, destinationPath string) {
+	for _, pattern := range []string{destinationPath + ".new-*", destinationPath + ".old-*"} {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if _, err := os.Stat(match); err != nil && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			WarningW(writer, "Removing orphaned directory from a previous run: "+match)
+			os.RemoveAll(match)
+		}
+	}
+}
+
+/*
+*
+Copy sourceDir into destinationPath without ever leaving destinationPath
+half-copied: the copy lands in a sibling staging directory first, and
+only a rename (not a copy) puts it in place. If anything fails partway,
+we roll back by renaming the old destination back over its original
+path, so the caller always ends up with either the old tree or the new
+tree, never a torn one.
+
+Expects
+1. writer - Where progress for this project is printed
+2. sourceDir - Directory to copy from
+3. destinationPath - Final destination path
+4. dryRun - If true, only log the swap that would happen instead of performing it
+
+Returns
+1. error - non-nil if the swap could not be completed
+*
+*/
+func atomicSwapDestination(writer io.Writer, sourceDir string, destinationPath string, dryRun bool) error {
+	timestamp := time.Now().UnixNano()
+	stagingDir := fmt.Sprintf("%s.new-%d", destinationPath, timestamp)
+	oldDir := fmt.Sprintf("%s.old-%d", destinationPath, timestamp)
+
+	if dryRun {
+		logPlannedAction(writer, "Would atomically swap destination", fmt.Sprintf("%s -> %s (staging: %s)", sourceDir, destinationPath, stagingDir))
+		return nil
+	}
+
+	InfoW(writer, "Copying into staging directory: "+stagingDir)
+	if err := copyDir.Copy(sourceDir, stagingDir); err != nil {
+		os.RemoveAll(stagingDir)
+		return fmt.Errorf("error while copying into staging directory: %w", err)
+	}
+
+	destinationExists := true
+	if _, err := os.Stat(destinationPath); errors.Is(err, fs.ErrNotExist) {
+		destinationExists = false
+	}
+
+	if destinationExists {
+		LogW(writer, "Moving current destination aside: "+oldDir, true)
+		if err := os.Rename(destinationPath, oldDir); err != nil {
+			os.RemoveAll(stagingDir)
+			return fmt.Errorf("error while moving current destination aside: %w", err)
+		}
+	}
+
+	if err := os.Rename(stagingDir, destinationPath); err != nil {
+		if destinationExists {
+			if rollbackErr := os.Rename(oldDir, destinationPath); rollbackErr != nil {
+				WarningW(writer, "Error while rolling back the destination swap: "+rollbackErr.Error())
+			}
+		}
+		return fmt.Errorf("error while swapping the staging directory into place: %w", err)
+	}
+
+	if destinationExists {
+		os.RemoveAll(oldDir)
+	}
+
+	SuccessW(writer, "Destination swapped atomically: "+destinationPath)
+	return nil
+}
+
+/*
+*
+Copy sourceDir into destinationPath, or, if dryRun, just log that a copy
+would have happened.
+
+Expects
+1. writer - Where this project's progress is printed
+2. sourceDir - Directory to copy from
+3. destinationPath - Directory to copy into
+4. dryRun - If true, only log what would happen instead of copying anything
+
+Returns
+1. error - non-nil if the copy failed
+*
+*/
+func copyWithDryRun(writer io.Writer, sourceDir string, destinationPath string, dryRun bool) error {
+	if dryRun {
+		logPlannedAction(writer, "Would copy directory", sourceDir+" -> "+destinationPath)
+		return nil
+	}
+	return copyDir.Copy(sourceDir, destinationPath)
+}
+
+/*
+*
+Walk an overlay's source directory and warn about any file that already
+exists at the corresponding path in the destination, since the overlay
+copy is about to silently overwrite it (later overlays win).
+
+Expects
+1. writer - Where progress for this project is printed
+2. sourceDir - The overlay's (sparse-checked-out) source directory
+3. destinationPath - The project's DestinationPath
+
+Returns
+1. void
+*
+*/
+func reportOverlayConflicts(writer io.Writer, sourceDir string, destinationPath string) {
+	filepath.Walk(sourceDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return nil
+		}
+		relPath, relErr := filepath.Rel(sourceDir, filePath)
+		if relErr != nil {
+			return nil
+		}
+		destPath := path.Join(destinationPath, relPath)
+		if _, statErr := os.Stat(destPath); statErr == nil {
+			WarningW(writer, "Overlay will overwrite existing file: "+relPath)
+		}
+		return nil
+	})
+}
+
+/*
+*
+Clone a single overlay and merge it into destinationPath, on top of
+whatever is already there (the base project, or an earlier overlay).
+
+Expects
+1. ctx - Cancelled if a sibling project fails and fail_fast is set
+2. writer - Where progress for this project is printed
+3. overlay - The overlay to apply
+4. baseTempDir - The owning project's (already-unique) TempDirectory
+5. index - This overlay's position in Project.Overlays, used to keep its temp dir unique
+6. destinationPath - The project's DestinationPath
+7. dryRun - If true, only log the clone/merge that would happen instead of performing it
+
+Returns
+1. LockEntry - The overlay's resolved repo/commit, for the lock file (zero value if dryRun)
+2. error - non-nil if the overlay could not be cloned or merged
+*
+*/
+func applyOverlay(ctx context.Context, writer io.Writer, overlay Overlay, baseTempDir string, index int, destinationPath string, dryRun bool) (LockEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return LockEntry{}, err
+	}
+
+	overlayTempDir := uniqueTempDir(fmt.Sprintf("%s-overlay-%d", baseTempDir, index))
+	if !createDirectoryIfNotExists(writer, overlayTempDir, dryRun) {
+		return LockEntry{}, fmt.Errorf("overlay temp directory was NOT created successfully: %s", overlayTempDir)
+	}
+	defer deleteDirectory(writer, overlayTempDir, dryRun)
+
+	overlayProject := Project{RepoURL: overlay.RepoURL, Ref: overlay.Ref, SparsePaths: overlay.SparsePaths}
+	if !cloneRepository(writer, overlayProject, overlayTempDir, dryRun) {
+		return LockEntry{}, fmt.Errorf("error while cloning the overlay repository: %s", overlay.RepoURL)
+	}
+	InfoW(writer, "Cloned overlay: "+overlay.RepoURL)
+
+	overlaySourceDir := overlayTempDir
+	if overlay.Subpath != "" {
+		overlaySourceDir = path.Join(overlayTempDir, overlay.Subpath)
+	}
+
+	if dryRun {
+		logPlannedAction(writer, "Would merge overlay", overlay.RepoURL+" -> "+destinationPath)
+		return LockEntry{}, nil
+	}
+
+	reportOverlayConflicts(writer, overlaySourceDir, destinationPath)
+
+	if err := copyDir.Copy(overlaySourceDir, destinationPath); err != nil {
+		return LockEntry{}, fmt.Errorf("error while merging overlay %s: %w", overlay.RepoURL, err)
+	}
+	SuccessW(writer, "Merged overlay into destination: "+overlay.RepoURL)
+
+	commitSHA, _ := gitOutputInDir(writer, overlayTempDir, "rev-parse", "HEAD")
+	return LockEntry{RepoURL: overlay.RepoURL, CommitSHA: commitSHA}, nil
+}
+
+/*
+*
+Run the full clone -> copy -> cleanup pipeline for a single project.
+This is the unit of work fanned out to the worker pool in runProjects, so it
+reports failures as an error instead of calling os.Exit directly.
+
+Expects
+1. ctx - Cancelled if a sibling project fails and fail_fast is set
+2. project - The project to process
+3. writer - Where this project's progress is printed
+4. dryRun - If true, every disk-touching step only logs what it would do
+
+Returns
+1. []LockEntry - The resolved repo/commit of the project and each of its overlays, for the lock file (empty if dryRun)
+2. error - non-nil if any step of the pipeline failed
+*
+*/
+func processProject(ctx context.Context, project Project, writer io.Writer, dryRun bool) ([]LockEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	project.TempDirectory = uniqueTempDir(project.TempDirectory)
+
+	LogW(writer, "Repo URL: "+project.RepoURL, true)
+	LogW(writer, "Destination Path: "+project.DestinationPath, true)
+	LogW(writer, "Temp Directory: "+project.TempDirectory, true)
+	LogW(writer, "Delete Temp Directory: "+fmt.Sprint(project.DeleteTempDirectory), true)
+	LogW(writer, "Project Name: "+project.ProjectName, true)
+	LogW(writer, "Purge Destination: "+fmt.Sprint(project.PurgeDestination), true)
+
+	// lets start reading the temporary directory
+	// we use this temporary directory to clone the repository
+	if !createDirectoryIfNotExists(writer, project.TempDirectory, dryRun) {
+		return nil, fmt.Errorf("temp directory was NOT created successfully: %s", project.TempDirectory)
+	}
+	SuccessW(writer, "Temp Directory was created successfully.")
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// git clone the repository in the temp directory
+	if !cloneRepository(writer, project, project.TempDirectory, dryRun) {
+		return nil, fmt.Errorf("error while cloning the repository: %s", project.RepoURL)
+	}
+	SuccessW(writer, "Cloned the repository successfully")
+	InfoW(writer, "Prep the copy process")
+
+	sourceDir := path.Join(project.TempDirectory, project.ProjectName)
+	SuccessW(writer, "Generated  source directory: "+sourceDir)
+
+	if project.AtomicSwap {
+		if !dryRun {
+			cleanupOrphanSwapSiblings(writer, project.DestinationPath)
+		}
+		if err := atomicSwapDestination(writer, sourceDir, project.DestinationPath, dryRun); err != nil {
+			return nil, err
+		}
+	} else {
+		if !dryRun && checkIfDirectoryExists(project.DestinationPath) {
+			InfoW(writer, "Destination directory exists.")
+		} else {
+			LogW(writer, "Destination directory does NOT exist. Will attempt to create the destination directory", true)
+			createDirectoryIfNotExists(writer, project.DestinationPath, dryRun)
+		}
+
+		// check if we need to purge the destination directory first
+		if project.PurgeDestination {
+			LogW(writer, "Purge the destination directory", true)
+			if !deleteDirectory(writer, project.DestinationPath, dryRun) {
+				return nil, fmt.Errorf("error while purging the destination directory: %s", project.DestinationPath)
+			}
+			LogW(writer, "Purging the destination directory has happened succesfully", true)
+			LogW(writer, "Create the destination directory : "+project.DestinationPath, true)
+			if !createDirectoryIfNotExists(writer, project.DestinationPath, dryRun) {
+				return nil, fmt.Errorf("destination directory could not be created: %s", project.DestinationPath)
+			}
+			LogW(writer, "Destination directory has been created", true)
+		}
+
+		if err := copyWithDryRun(writer, sourceDir, project.DestinationPath, dryRun); err != nil {
+			return nil, fmt.Errorf("error while copying the files: %w", err)
+		}
+		SuccessW(writer, "Files were copied successfully.")
+	}
+
+	var lockEntries []LockEntry
+	if !dryRun {
+		commitSHA, _ := gitOutputInDir(writer, project.TempDirectory, "rev-parse", "HEAD")
+		lockEntries = []LockEntry{{ProjectName: project.ProjectName, RepoURL: project.RepoURL, CommitSHA: commitSHA}}
+	}
+
+	for i, overlay := range project.Overlays {
+		InfoW(writer, fmt.Sprintf("Applying overlay %d/%d: %s", i+1, len(project.Overlays), overlay.RepoURL))
+		overlayEntry, err := applyOverlay(ctx, writer, overlay, project.TempDirectory, i, project.DestinationPath, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		if !dryRun {
+			overlayEntry.ProjectName = project.ProjectName
+			lockEntries = append(lockEntries, overlayEntry)
+		}
+	}
+
+	if project.DeleteTempDirectory {
+		InfoW(writer, "Will now delete the directory: "+project.TempDirectory)
+		deleteDirectory(writer, project.TempDirectory, dryRun)
+	} else {
+		InfoW(writer, "Directory cleanup will not happen")
+	}
+
+	SuccessW(writer, "Finished processing the project: "+project.ProjectName)
+	return lockEntries, nil
+}
+
+/*
+*
+Fill in any Project field left at its zero value with the manifest's
+top-level defaults, so common values like temp_directory/remote/ref don't
+have to be repeated on every project.
+
+Expects
+1. projects - The parsed manifest, mutated in place
+
+Returns
+1. void
+*
+*/
+func applyDefaults(projects *Projects) {
+	for i := range projects.Projects {
+		project := &projects.Projects[i]
+		if project.TempDirectory == "" {
+			project.TempDirectory = projects.Defaults.TempDirectory
+		}
+		if project.Remote == "" {
+			project.Remote = projects.Defaults.Remote
+		}
+		if project.Ref == "" {
+			project.Ref = projects.Defaults.Ref
+		}
+	}
+}
+
+/*
+*
+Parse the tool's command-line flags.
+
+--dry-run   report the actions each step would take, without touching disk
+--plan      resolve refs and diff against the destination, without touching the
+            destination (the source tree is cloned into a temp directory)
+--update    ignore l1onResources.lock.json and re-resolve refs fresh
+
+Returns
+1. CLIFlags - the parsed flags
+*
+*/
+func parseFlags() CLIFlags {
+	dryRun := flag.Bool("dry-run", false, "Report the actions that would be taken without touching disk")
+	plan := flag.Bool("plan", false, "Resolve refs and diff against the destination without touching it (clones into a temp directory)")
+	update := flag.Bool("update", false, "Ignore l1onResources.lock.json and re-resolve refs fresh")
+	flag.Parse()
+	return CLIFlags{DryRun: *dryRun, Plan: *plan, Update: *update}
+}
+
+/*
+*
+Check whether the user asked to bypass the lock file and re-resolve refs
+fresh.
+
+Returns
+1. boolean - If --update was passed on the command line
+*
+*/
+func hasUpdateFlag() bool {
+	return cli.Update
+}
+
+/*
+*
+Print a single planned-but-not-executed action via pterm.DefaultTable,
+used by the --dry-run no-op paths. Takes the project's writer so dry-run
+output for concurrent workers stays inside that project's MultiPrinter
+area instead of interleaving on global stdout.
+
+Expects
+1. writer - Where this project's progress is printed
+2. action - Short description of the action, e.g. "Would clone repository"
+3. detail - The path(s)/URL(s) involved
+
+Returns
+1. void
+*
+*/
+func logPlannedAction(writer io.Writer, action string, detail string) {
+	data := pterm.TableData{{"Action", "Detail"}, {action, detail}}
+	pterm.DefaultTable.WithWriter(writer).WithHasHeader().WithData(data).Render()
+}
+
+func readLockFile() (Lockfile, bool) {
+	var lockfile Lockfile
+	if !checkIfFileExists(LOCK_FILE_NAME) {
+		return lockfile, false
+	}
+
+	lockFile, err := os.Open(LOCK_FILE_NAME)
+	if err != nil {
+		Error("Lock file might not exist as we are not able to read it.")
+		return lockfile, false
+	}
+	defer lockFile.Close()
+
+	byteArray, _ := ioutil.ReadAll(lockFile)
+	json.Unmarshal(byteArray, &lockfile)
+	return lockfile, true
+}
+
+func writeLockFile(entries []LockEntry) error {
+	lockfile := Lockfile{Repos: entries}
+	byteArray, err := json.MarshalIndent(lockfile, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while marshalling the lock file: %w", err)
+	}
+	if err := ioutil.WriteFile(LOCK_FILE_NAME, byteArray, os.ModePerm); err != nil {
+		return fmt.Errorf("error while writing the lock file: %w", err)
+	}
+	return nil
+}
+
+/*
+*
+When a lock file is present, pin every project's and overlay's Ref to the
+commit SHA it resolved to on the last successful run, so repeat runs are
+reproducible instead of floating on a branch. Passing --update skips this
+and lets refs resolve fresh again.
+
+Expects
+1. projects - The parsed manifest (after applyDefaults), mutated in place
+
+Returns
+1. void
+*
+*/
+func pinRefsToLockfile(projects *Projects) {
+	if hasUpdateFlag() {
+		Info("--update passed, ignoring the lock file and resolving refs fresh.")
+		return
+	}
+
+	lockfile, ok := readLockFile()
+	if !ok {
+		return
+	}
+	Info("Lock file found, pinning refs to the resolved commit SHAs.")
+
+	locked := make(map[string]string)
+	for _, entry := range lockfile.Repos {
+		locked[entry.ProjectName+"|"+entry.RepoURL] = entry.CommitSHA
+	}
+
+	for i := range projects.Projects {
+		project := &projects.Projects[i]
+		if sha, found := locked[project.ProjectName+"|"+project.RepoURL]; found {
+			project.Ref = sha
+		}
+		for j := range project.Overlays {
+			overlay := &project.Overlays[j]
+			if sha, found := locked[project.ProjectName+"|"+overlay.RepoURL]; found {
+				overlay.Ref = sha
+			}
+		}
+	}
+}
+
+/*
+*
+Two-phase manifest load: parse l1onResources.json, merge in the
+top-level defaults, then reconcile refs against l1onResources.lock.json
+if one exists.
+*/
 func readConfigFile() Projects {
 	generateSectionHeader("Validate the config file")
 	var projects Projects
@@ -253,90 +1092,359 @@ func readConfigFile() Projects {
 		byteArray, _ := ioutil.ReadAll(configFile)
 		json.Unmarshal(byteArray, &projects)
 
+		applyDefaults(&projects)
+		pinRefsToLockfile(&projects)
+
 	} else {
 		Error("Config file does NOT exist in the current folder.")
 	}
 	return projects
 }
 
+// projectJob pairs a project with the MultiPrinter writer it should log to.
+// The writer is created on the single feeding goroutine in runProjects, not
+// by the workers, since pterm.MultiPrinter.NewWriter() is not safe to call
+// concurrently.
+type projectJob struct {
+	project Project
+	writer  io.Writer
+}
+
+/*
+*
+Fan out processProject over projects.Projects using a bounded worker pool.
+Workers never call os.Exit themselves; errors are collected and reported
+by main once every worker has finished, and, if FailFast is set, a failure
+cancels ctx so peers still queued can bail out early.
+
+Expects
+1. ctx - Parent context; cancelled internally on first failure if projects.FailFast
+2. projects - The parsed config
+3. multi - The multi printer each worker gets its progress area from
+4. dryRun - If true, every worker only logs what it would do instead of touching disk
+
+Returns
+1. []error - One entry per project that failed to process
+2. []LockEntry - The resolved repo/commit of every project and overlay that succeeded (empty if dryRun)
+*
+*/
+func runProjects(ctx context.Context, projects Projects, multi *pterm.MultiPrinter, dryRun bool) ([]error, []LockEntry) {
+	concurrency := projects.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan projectJob)
+	errs := make([]error, 0)
+	lockEntries := make([]LockEntry, 0)
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				entries, err := processProject(ctx, job.project, job.writer, dryRun)
+				resultsMutex.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", job.project.ProjectName, err))
+				} else {
+					lockEntries = append(lockEntries, entries...)
+				}
+				resultsMutex.Unlock()
+				if err != nil && projects.FailFast {
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range projects.Projects {
+		job := projectJob{project: projects.Projects[i], writer: multi.NewWriter()}
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- job:
+		}
+	}
+	close(jobs)
+
+	wg.Wait()
+	return errs, lockEntries
+}
+
+/*
+*
+Resolve the commit that ref (branch/tag/commit, defaulting to HEAD)
+currently points to on the remote, without cloning anything.
+If ref is already a full commit SHA (e.g. pinned by the lock file), it is
+already resolved and is returned as-is: "git ls-remote <url> <sha>" only
+matches ref names, not arbitrary commits, and would fail to find it.
+
+Expects
+1. repoURL - URL of the repository
+2. ref - Branch/tag/commit to resolve; "" means HEAD
+
+Returns
+1. string - The resolved commit SHA
+2. boolean - If the ref was resolved successfully or not
+*
+*/
+func resolveRemoteRef(repoURL string, ref string) (string, bool) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if isCommitSHA(ref) {
+		return ref, true
+	}
+	cmd := exec.Command("git", "ls-remote", repoURL, ref)
+	output, err := cmd.Output()
+	if err != nil {
+		Warning("Error while resolving ref '" + ref + "' for: " + repoURL)
+		return "", false
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		Warning("Ref '" + ref + "' did not resolve to anything for: " + repoURL)
+		return "", false
+	}
+	return fields[0], true
+}
+
+/*
+*
+SHA-256 hash a file's contents, used by diffTrees to tell a changed file
+from an unchanged one.
+
+Expects
+1. filePath - Path to the file
+
+Returns
+1. string - Hex-encoded digest
+2. error - non-nil if the file could not be read
+*
+*/
+func fileHash(filePath string) (string, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*
+*
+Walk sourceDir and destinationPath and summarize what copying sourceDir
+over destinationPath would add, modify (by content hash), or remove.
+
+Expects
+1. sourceDir - The resolved source tree
+2. destinationPath - What's already on disk at the project's DestinationPath
+
+Returns
+1. DiffSummary - files added/modified/removed and the net bytes delta
+2. error - non-nil if either tree could not be walked
+*
+*/
+func diffTrees(sourceDir string, destinationPath string) (DiffSummary, error) {
+	var summary DiffSummary
+
+	sourceFiles := make(map[string]int64)
+	if err := filepath.Walk(sourceDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relPath, relErr := filepath.Rel(sourceDir, filePath)
+		if relErr != nil {
+			return relErr
+		}
+		sourceFiles[relPath] = info.Size()
+		return nil
+	}); err != nil {
+		return summary, fmt.Errorf("error while walking the source tree: %w", err)
+	}
+
+	destFiles := make(map[string]int64)
+	if checkIfDirectoryExists(destinationPath) {
+		if err := filepath.Walk(destinationPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			relPath, relErr := filepath.Rel(destinationPath, filePath)
+			if relErr != nil {
+				return relErr
+			}
+			destFiles[relPath] = info.Size()
+			return nil
+		}); err != nil {
+			return summary, fmt.Errorf("error while walking the destination tree: %w", err)
+		}
+	}
+
+	for relPath, sourceSize := range sourceFiles {
+		destSize, exists := destFiles[relPath]
+		if !exists {
+			summary.FilesAdded++
+			summary.BytesDelta += sourceSize
+			continue
+		}
+		sourceHash, _ := fileHash(path.Join(sourceDir, relPath))
+		destHash, _ := fileHash(path.Join(destinationPath, relPath))
+		if sourceHash != destHash {
+			summary.FilesModified++
+			summary.BytesDelta += sourceSize - destSize
+		}
+	}
+	for relPath, destSize := range destFiles {
+		if _, exists := sourceFiles[relPath]; !exists {
+			summary.FilesRemoved++
+			summary.BytesDelta -= destSize
+		}
+	}
+
+	return summary, nil
+}
+
+/*
+*
+Preview what a real run would do to a single project: resolve its
+effective ref against the remote, then, if the destination already
+exists, diff the resolved source tree against it. Nothing under
+DestinationPath is ever touched; the only disk write is the project's own
+temp clone, used purely to read the tree for diffing.
+
+Expects
+1. project - The project to preview
+2. writer - Where this project's progress is printed
+
+Returns
+1. DiffSummary - files added/modified/removed and the net bytes delta; all
+   zero when DestinationPath does not exist yet, since no diff is taken
+2. error - non-nil if the ref could not be resolved or the trees could not be diffed
+*
+*/
+func planProject(project Project, writer io.Writer) (DiffSummary, error) {
+	InfoW(writer, "Resolving remote ref for: "+project.RepoURL)
+	commitSHA, ok := resolveRemoteRef(project.RepoURL, project.Ref)
+	if !ok {
+		return DiffSummary{}, fmt.Errorf("error while resolving remote ref for: %s", project.RepoURL)
+	}
+	SuccessW(writer, "Resolved ref to commit: "+commitSHA)
+
+	if !checkIfDirectoryExists(project.DestinationPath) {
+		InfoW(writer, "Destination does not exist yet; everything would be added.")
+		return DiffSummary{}, nil
+	}
+
+	tempDir := uniqueTempDir(project.TempDirectory)
+	if !createDirectoryIfNotExists(writer, tempDir, false) {
+		return DiffSummary{}, fmt.Errorf("plan temp directory was NOT created successfully: %s", tempDir)
+	}
+	defer deleteDirectory(writer, tempDir, false)
+
+	if !cloneRepository(writer, project, tempDir, false) {
+		return DiffSummary{}, fmt.Errorf("error while cloning the repository for --plan: %s", project.RepoURL)
+	}
+
+	sourceDir := path.Join(tempDir, project.ProjectName)
+	summary, err := diffTrees(sourceDir, project.DestinationPath)
+	if err != nil {
+		return DiffSummary{}, err
+	}
+
+	InfoW(writer, fmt.Sprintf("Plan: +%d added, ~%d modified, -%d removed, %d bytes delta", summary.FilesAdded, summary.FilesModified, summary.FilesRemoved, summary.BytesDelta))
+	return summary, nil
+}
+
+/*
+*
+Run --plan mode: preview every project and print a per-project and
+aggregate summary table before exiting, without touching any destination.
+
+Expects
+1. projects - The parsed config
+
+Returns
+1. void
+*
+*/
+func runPlan(projects Projects) {
+	generateSectionHeader("Plan")
+
+	var aggregate DiffSummary
+	rows := pterm.TableData{{"Project", "Added", "Modified", "Removed", "Bytes Delta"}}
+
+	for _, project := range projects.Projects {
+		generateSectionHeader("Project Name: " + project.ProjectName)
+		summary, err := planProject(project, os.Stdout)
+		if err != nil {
+			Error("Error while planning project " + project.ProjectName + ": " + err.Error())
+			continue
+		}
+		rows = append(rows, []string{
+			project.ProjectName,
+			fmt.Sprint(summary.FilesAdded),
+			fmt.Sprint(summary.FilesModified),
+			fmt.Sprint(summary.FilesRemoved),
+			fmt.Sprint(summary.BytesDelta),
+		})
+		aggregate.FilesAdded += summary.FilesAdded
+		aggregate.FilesModified += summary.FilesModified
+		aggregate.FilesRemoved += summary.FilesRemoved
+		aggregate.BytesDelta += summary.BytesDelta
+	}
+
+	rows = append(rows, []string{
+		"TOTAL",
+		fmt.Sprint(aggregate.FilesAdded),
+		fmt.Sprint(aggregate.FilesModified),
+		fmt.Sprint(aggregate.FilesRemoved),
+		fmt.Sprint(aggregate.BytesDelta),
+	})
+	pterm.DefaultTable.WithHasHeader().WithData(rows).Render()
+}
+
 func main() {
+	cli = parseFlags()
+	rand.Seed(time.Now().UnixNano())
 	pterm.EnableDebugMessages() // Enable debug messages
 	generateWelcomeHeader()
 	projects := readConfigFile()
 	if len(projects.Projects) > 0 {
 		Log("Config file was successfully read and the struct was populated.", true)
 		Log("There are "+fmt.Sprint(len(projects.Projects), " projects"), true)
-		for i := 0; i < len(projects.Projects); i++ {
-			project := projects.Projects[i]
-			//config file was successfully read and the struct was populated.
-			generateSectionHeader("Project Name: " + project.ProjectName)
-
-			Log("Repo URL: "+project.RepoURL, true)
-			Log("Destination Path: "+project.DestinationPath, true)
-			Log("Temp Directory: "+project.TempDirectory, true)
-			Log("Delete Temp Directory: "+fmt.Sprint(project.DeleteTempDirectory), true)
-			Log("Project Name: "+project.ProjectName, true)
-			Log("Purge Destination: "+fmt.Sprint(project.PurgeDestination), true)
-
-			// lets start reading the temporary directory
-			// we use this temporary directory to clone the repository
-			tempDirectoryaVal := createDirectoryIfNotExists(project.TempDirectory)
-			if tempDirectoryaVal {
-				Success("Temp Directory was created successfully.")
-				// git clone the repository in the temp directory
-				directoryClonedSuccessFully := cloneRepository(project.RepoURL, project.TempDirectory)
-				if !directoryClonedSuccessFully {
-					Warning("Error while cloning the repository. Please check the logs.")
-					os.Exit(1)
-				}
-				Success("Cloned the repository successfully: " + fmt.Sprint(directoryClonedSuccessFully))
-				Info("Prep the copy process")
-				sourceDir := path.Join(project.TempDirectory, project.ProjectName)
-				Success("Generated  source directory: " + sourceDir)
-				if checkIfDirectoryExists(project.DestinationPath) {
-					Info("Destination directory exists.")
-				} else {
-					Log("Destination directory does NOT exist. Will attempt to create the destination directory", true)
-					createDirectoryIfNotExists(project.DestinationPath)
-				}
-				// check if we need to purge the destination directory first
-				if project.PurgeDestination {
-					Log("Purge the destination directory", true)
-					deleteError := deleteDirectory(project.DestinationPath)
-					if deleteError {
-						Log("Purging the destination directory has happened succesfully", true)
-						Log("Create the destination directory : "+project.DestinationPath, true)
-						destinationPathSuccess := createDirectoryIfNotExists(project.DestinationPath)
-						if destinationPathSuccess {
-							Log("Destination directory has been created", true)
-						} else {
-							Log("Destination directory could not be created : "+project.DestinationPath, true)
-							os.Exit(1)
-						}
-					} else {
-						Warning("Error while purging the destination directory")
-						os.Exit(1)
-					}
-				}
-				copyError := copyDir.Copy(sourceDir, project.DestinationPath)
-				if copyError != nil {
-					Log("Error while copying the files: "+copyError.Error(), true)
-					os.Exit(1)
-				}
-				Success("Files were copied successfully.")
-				if project.DeleteTempDirectory {
-					Info("Will now delete the directory: " + project.DestinationPath)
-					// lets delete the directory now
-					deleteDirectory(project.TempDirectory)
-				} else {
-					Info("Directory cleanup will not happen")
-				}
-				Success("Finished processing the project: " + project.ProjectName)
+
+		if cli.Plan {
+			runPlan(projects)
+			os.Exit(0)
+		}
+
+		multi := pterm.DefaultMultiPrinter
+		multi.Start()
+		errs, lockEntries := runProjects(context.Background(), projects, &multi, cli.DryRun)
+		multi.Stop()
+
+		if len(lockEntries) > 0 {
+			if err := writeLockFile(lockEntries); err != nil {
+				Warning("Error while writing the lock file: " + err.Error())
 			} else {
-				Warning("Temp Directory was NOT created successfully, aborting!")
-				os.Exit(1)
+				Success("Wrote " + LOCK_FILE_NAME)
 			}
 		}
+
+		if len(errs) > 0 {
+			for _, err := range errs {
+				Error(err.Error())
+			}
+			os.Exit(1)
+		}
+
 		generateSectionHeader("All done. Exiting now.")
 		os.Exit(0)
 	} else {